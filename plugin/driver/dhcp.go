@@ -0,0 +1,205 @@
+package driver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+
+	. "github.com/weaveworks/weave/common"
+)
+
+// Per-network option selecting how endpoints on it get their address.
+// The default, unset, means "ask IPAM" (see ipam.go); the only other
+// value understood is "dhcp".
+const (
+	AddressingOption = "weave.addressing"
+	dhcpAddressing   = "dhcp"
+
+	dhcpServerPort   = 67
+	dhcpClientPort   = 68
+	dhcpMagicCookie  = 0x63825363
+	defaultLeaseTime = time.Hour
+)
+
+// DHCP message types (RFC 2132 option 53).
+const (
+	dhcpMsgDiscover = 1
+	dhcpMsgOffer    = 2
+	dhcpMsgRequest  = 3
+	dhcpMsgAck      = 5
+	dhcpMsgRelease  = 7
+)
+
+// DHCP option codes we care about.
+const (
+	optSubnetMask   = 1
+	optRouter       = 3
+	optDNS          = 6
+	optRequestedIP  = 50
+	optLeaseTime    = 51
+	optMessageType  = 53
+	optServerID     = 54
+	optParamRequest = 55
+	optEnd          = 255
+)
+
+// dhcpLease is what a DHCP exchange got us for one endpoint, and the
+// state needed to keep it renewed for as long as the endpoint exists.
+type dhcpLease struct {
+	mac       net.HardwareAddr
+	serverID  net.IP
+	address   *net.IPNet
+	gateway   net.IP
+	dns       []net.IP
+	leaseTime time.Duration
+	stop      chan struct{}
+	released  sync.Once
+}
+
+// macForEndpoint derives a stable, locally-administered MAC address for
+// an endpoint that doesn't have an IP yet to base makeMac on - which is
+// exactly the case when addressing is being delegated to DHCP.
+func macForEndpoint(endpointID string) net.HardwareAddr {
+	h := fnv.New32a()
+	h.Write([]byte(endpointID))
+	sum := h.Sum32()
+	hw := make(net.HardwareAddr, 6)
+	hw[0] = 0x7a
+	hw[1] = 0x42
+	binary.BigEndian.PutUint32(hw[2:], sum)
+	return hw
+}
+
+// dhcpRequest performs a DISCOVER/OFFER/REQUEST/ACK exchange on the
+// given bridge for mac, and returns the lease the server handed out.
+func (driver *driver) dhcpRequest(bridge string, mac net.HardwareAddr) (*dhcpLease, error) {
+	conn, err := dhcpConnFor(bridge)
+	if err != nil {
+		return nil, fmt.Errorf("dhcp: %s", err)
+	}
+
+	xid := bindXid(mac)
+
+	offer, err := conn.exchange(buildDHCPPacket(xid, mac, dhcpMsgDiscover, nil, nil))
+	if err != nil {
+		return nil, fmt.Errorf("dhcp discover: %s", err)
+	}
+	offeredIP := offer.yiaddr()
+	serverID := net.IP(offer.options()[optServerID])
+
+	ack, err := conn.exchange(buildDHCPPacket(xid, mac, dhcpMsgRequest, offeredIP, serverID))
+	if err != nil {
+		return nil, fmt.Errorf("dhcp request: %s", err)
+	}
+
+	return leaseFromAck(mac, ack), nil
+}
+
+// dhcpRenew asks the server that gave us lease to extend it. The
+// address itself does not change; only the lease's fields are updated
+// in place.
+func (driver *driver) dhcpRenew(bridge string, lease *dhcpLease) error {
+	conn, err := dhcpConnFor(bridge)
+	if err != nil {
+		return fmt.Errorf("dhcp: %s", err)
+	}
+
+	xid := bindXid(lease.mac)
+	ack, err := conn.exchange(buildDHCPPacket(xid, lease.mac, dhcpMsgRequest, lease.address.IP, lease.serverID))
+	if err != nil {
+		return fmt.Errorf("dhcp renew: %s", err)
+	}
+	renewed := leaseFromAck(lease.mac, ack)
+	lease.gateway = renewed.gateway
+	lease.dns = renewed.dns
+	lease.leaseTime = renewed.leaseTime
+	return nil
+}
+
+// dhcpReleaseLease tells the server we are done with the address. It is
+// best-effort: DHCPRELEASE has no reply to wait for.
+func (driver *driver) dhcpReleaseLease(bridge string, lease *dhcpLease) error {
+	conn, err := dhcpConnFor(bridge)
+	if err != nil {
+		return fmt.Errorf("dhcp: %s", err)
+	}
+
+	p := buildDHCPPacket(bindXid(lease.mac), lease.mac, dhcpMsgRelease, nil, lease.serverID)
+	p.setCiaddr(lease.address.IP)
+	return conn.send(p)
+}
+
+// releaseLease stops lease's renewal goroutine and tells the DHCP
+// server we're done with the address. Both deleteEndpoint and
+// leaveEndpoint call this, so it is guarded with a sync.Once: whichever
+// of the two runs first does the work, and the other is a no-op.
+func (driver *driver) releaseLease(bridge, endpointID string, lease *dhcpLease) {
+	lease.released.Do(func() {
+		close(lease.stop)
+		if err := driver.dhcpReleaseLease(bridge, lease); err != nil {
+			Log.Warningf("dhcp: failed to release lease for endpoint %s: %s", endpointID, err)
+		}
+	})
+}
+
+// renewLease keeps a lease alive until lease.stop is closed, which
+// happens from whichever of leaveEndpoint/deleteEndpoint runs first -
+// so renewal stops at Leave even though the endpoint's entry in
+// driver.networks stays until DeleteEndpoint.
+func (driver *driver) renewLease(bridge, endpointID string, lease *dhcpLease) {
+	for {
+		renewAfter := lease.leaseTime / 2
+		if renewAfter <= 0 {
+			renewAfter = defaultLeaseTime / 2
+		}
+		select {
+		case <-lease.stop:
+			return
+		case <-time.After(renewAfter):
+			if err := driver.dhcpRenew(bridge, lease); err != nil {
+				Warning.Printf("dhcp: failed to renew lease for endpoint %s: %s", endpointID, err)
+			}
+		}
+	}
+}
+
+func leaseFromAck(mac net.HardwareAddr, ack *dhcpPacket) *dhcpLease {
+	opts := ack.options()
+	lease := &dhcpLease{
+		mac:       mac,
+		serverID:  net.IP(opts[optServerID]),
+		address:   &net.IPNet{IP: ack.yiaddr(), Mask: subnetMaskOption(opts)},
+		leaseTime: leaseTimeOption(opts),
+		stop:      make(chan struct{}),
+	}
+	if gw := opts[optRouter]; len(gw) >= net.IPv4len {
+		lease.gateway = net.IP(gw[:net.IPv4len])
+	}
+	for data := opts[optDNS]; len(data) >= net.IPv4len; data = data[net.IPv4len:] {
+		lease.dns = append(lease.dns, net.IP(data[:net.IPv4len]))
+	}
+	return lease
+}
+
+func subnetMaskOption(opts map[byte][]byte) net.IPMask {
+	if mask := opts[optSubnetMask]; len(mask) == net.IPv4len {
+		return net.IPMask(mask)
+	}
+	return net.CIDRMask(24, 32)
+}
+
+func leaseTimeOption(opts map[byte][]byte) time.Duration {
+	if data := opts[optLeaseTime]; len(data) == 4 {
+		return time.Duration(binary.BigEndian.Uint32(data)) * time.Second
+	}
+	return defaultLeaseTime
+}
+
+func bindXid(mac net.HardwareAddr) uint32 {
+	h := fnv.New32a()
+	h.Write(mac)
+	return h.Sum32()
+}
@@ -0,0 +1,180 @@
+package driver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// dhcpPacket is a RFC 2131 BOOTP/DHCP message: a 236-byte fixed header,
+// a 4-byte magic cookie, then a run of (code, length, value) options
+// terminated by an End (255) option.
+type dhcpPacket []byte
+
+const dhcpHeaderLen = 236
+
+func buildDHCPPacket(xid uint32, mac net.HardwareAddr, msgType byte, requestedIP, serverID net.IP) dhcpPacket {
+	p := make(dhcpPacket, dhcpHeaderLen, dhcpHeaderLen+64)
+	p[0] = 1 // BOOTREQUEST
+	p[1] = 1 // htype: Ethernet
+	p[2] = byte(len(mac))
+	binary.BigEndian.PutUint32(p[4:8], xid)
+	p[10] = 0x80 // broadcast flag: we have no address to receive a unicast reply on
+	copy(p[28:28+len(mac)], mac)
+
+	cookie := make([]byte, 4)
+	binary.BigEndian.PutUint32(cookie, dhcpMagicCookie)
+	p = append(p, cookie...)
+
+	p.setOption(optMessageType, []byte{msgType})
+	if requestedIP != nil {
+		p.setOption(optRequestedIP, requestedIP.To4())
+	}
+	if serverID != nil {
+		p.setOption(optServerID, serverID.To4())
+	}
+	p.setOption(optParamRequest, []byte{optSubnetMask, optRouter, optDNS, optLeaseTime})
+	p.setOption(optEnd, nil)
+	return p
+}
+
+func (p *dhcpPacket) setCiaddr(ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		copy((*p)[12:16], ip4)
+	}
+}
+
+// setOption appends an option, or - for optEnd - the terminator with no
+// length/value. It assumes options are only ever set once, in order,
+// which is all buildDHCPPacket needs.
+func (p *dhcpPacket) setOption(code byte, data []byte) {
+	if code == optEnd {
+		*p = append(*p, optEnd)
+		return
+	}
+	*p = append(*p, code, byte(len(data)))
+	*p = append(*p, data...)
+}
+
+func (p dhcpPacket) yiaddr() net.IP {
+	return net.IP(p[16:20])
+}
+
+// options parses the variable-length option section of the packet into
+// a map keyed by option code.
+func (p dhcpPacket) options() map[byte][]byte {
+	out := make(map[byte][]byte)
+	if len(p) <= dhcpHeaderLen+4 {
+		return out
+	}
+	buf := p[dhcpHeaderLen+4:]
+	for len(buf) > 0 {
+		code := buf[0]
+		if code == optEnd {
+			break
+		}
+		if code == 0 { // pad
+			buf = buf[1:]
+			continue
+		}
+		if len(buf) < 2 {
+			break
+		}
+		length := int(buf[1])
+		if len(buf) < 2+length {
+			break
+		}
+		out[code] = buf[2 : 2+length]
+		buf = buf[2+length:]
+	}
+	return out
+}
+
+// dhcpConn is a UDP socket bound to the client port. There can only
+// ever be one of these per bridge - the client port is a fixed,
+// well-known number - so dhcpConnFor below hands out one long-lived
+// instance per bridge rather than one per transaction, and exchange
+// serializes the transactions that share it.
+type dhcpConn struct {
+	mutex sync.Mutex
+	sock  *net.UDPConn
+}
+
+var (
+	dhcpConnsMutex sync.Mutex
+	dhcpConns      = map[string]*dhcpConn{}
+)
+
+// dhcpConnFor returns the dhcpConn for bridge, opening its socket the
+// first time it is needed. It does not bind to the named bridge device
+// - Go's net package has no portable SO_BINDTODEVICE - so it relies on
+// there being only one DHCP-enabled bridge on the host; the bridge name
+// is threaded through the call chain anyway so that can be tightened up
+// without changing callers. The socket is kept open for the life of the
+// process: opening and closing it per-transaction is what let two
+// transactions overlapping in time (two endpoints joining together, or
+// two lease renewals landing at once) fail to bind the client port.
+func dhcpConnFor(bridge string) (*dhcpConn, error) {
+	dhcpConnsMutex.Lock()
+	defer dhcpConnsMutex.Unlock()
+
+	if c, found := dhcpConns[bridge]; found {
+		return c, nil
+	}
+	laddr := &net.UDPAddr{Port: dhcpClientPort}
+	sock, err := net.ListenUDP("udp4", laddr)
+	if err != nil {
+		return nil, fmt.Errorf("could not bind DHCP client socket: %s", err)
+	}
+	c := &dhcpConn{sock: sock}
+	dhcpConns[bridge] = c
+	return c, nil
+}
+
+// sendLocked transmits p. Callers must hold c.mutex.
+func (c *dhcpConn) sendLocked(p dhcpPacket) error {
+	raddr := &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpServerPort}
+	_, err := c.sock.WriteToUDP(p, raddr)
+	return err
+}
+
+// send transmits p with no reply expected, used for DHCPRELEASE. It
+// takes the same mutex as exchange so it can't land in the middle of
+// another transaction's retry loop.
+func (c *dhcpConn) send(p dhcpPacket) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.sendLocked(p)
+}
+
+// exchange sends p and waits for a reply with a matching transaction
+// ID, retrying the send a couple of times in case of packet loss. It
+// holds the conn's mutex for the whole exchange, so concurrent
+// transactions on the same bridge queue up rather than racing to read
+// each other's replies off the shared socket.
+func (c *dhcpConn) exchange(p dhcpPacket) (*dhcpPacket, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	xid := binary.BigEndian.Uint32(p[4:8])
+	buf := make([]byte, 1500)
+	for attempt := 0; attempt < 3; attempt++ {
+		if err := c.sendLocked(p); err != nil {
+			return nil, err
+		}
+		c.sock.SetReadDeadline(time.Now().Add(3 * time.Second))
+		for {
+			n, err := c.sock.Read(buf)
+			if err != nil {
+				break // timed out waiting for this attempt; retry
+			}
+			reply := dhcpPacket(buf[:n])
+			if len(reply) > 8 && binary.BigEndian.Uint32(reply[4:8]) == xid {
+				return &reply, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no reply from DHCP server")
+}
@@ -6,8 +6,10 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"sync"
 
 	"github.com/docker/libnetwork/drivers/remote/api"
+	"github.com/docker/libnetwork/netlabel"
 	"github.com/docker/libnetwork/types"
 
 	. "github.com/weaveworks/weave/common"
@@ -18,9 +20,10 @@ import (
 )
 
 const (
-	MethodReceiver = "NetworkDriver"
-	WeaveContainer = "weave"
-	WeaveBridge    = "weave"
+	MethodReceiver     = "NetworkDriver"
+	IpamMethodReceiver = "IpamDriver"
+	WeaveContainer     = "weave"
+	WeaveBridge        = "weave"
 )
 
 type Driver interface {
@@ -28,12 +31,40 @@ type Driver interface {
 	Listen(net.Listener) error
 }
 
+// networkState is everything the driver needs to remember about one
+// network it has been asked to create: the subnet it was given by IPAM,
+// the options it was created with, and the endpoints that currently
+// live on it.
+type networkState struct {
+	id         string
+	subnet     *net.IPNet
+	options    map[string]interface{}
+	addressing string // "" (IPAM, the default) or dhcpAddressing
+	endpoints  map[string]*endpointState
+}
+
+type endpointState struct {
+	id         string
+	networkID  string
+	address    *net.IPNet
+	macAddress net.HardwareAddr
+	gateway    net.IP
+	dns        []net.IP
+	lease      *dhcpLease // non-nil iff this endpoint used DHCP addressing
+
+	portBindings []types.PortBinding
+	exposedPorts []types.TransportPort
+}
+
 type driver struct {
 	dockerer
 	version    string
-	network    string
 	nameserver string
 	watcher    Watcher
+
+	mutex     sync.Mutex
+	networks  map[string]*networkState
+	ipamPools map[string]*ipamPool
 }
 
 func New(version string) (Driver, error) {
@@ -51,8 +82,10 @@ func New(version string) (Driver, error) {
 		dockerer: dockerer{
 			client: client,
 		},
-		version: version,
-		watcher: watcher,
+		version:   version,
+		watcher:   watcher,
+		networks:  make(map[string]*networkState),
+		ipamPools: make(map[string]*ipamPool),
 	}, nil
 }
 
@@ -84,6 +117,17 @@ func (driver *driver) Listen(socket net.Listener) error {
 	handleMethod("Join", driver.joinEndpoint)
 	handleMethod("Leave", driver.leaveEndpoint)
 
+	handleIpamMethod := func(method string, h http.HandlerFunc) {
+		router.Methods("POST").Path(fmt.Sprintf("/%s.%s", IpamMethodReceiver, method)).HandlerFunc(h)
+	}
+
+	handleIpamMethod("GetCapabilities", driver.ipamGetCapabilities)
+	handleIpamMethod("GetDefaultAddressSpaces", driver.ipamGetDefaultAddressSpaces)
+	handleIpamMethod("RequestPool", driver.ipamRequestPool)
+	handleIpamMethod("ReleasePool", driver.ipamReleasePool)
+	handleIpamMethod("RequestAddress", driver.ipamRequestAddress)
+	handleIpamMethod("ReleaseAddress", driver.ipamReleaseAddress)
+
 	return http.Serve(socket, router)
 }
 
@@ -122,7 +166,7 @@ type handshakeResp struct {
 
 func (driver *driver) handshake(w http.ResponseWriter, r *http.Request) {
 	err := json.NewEncoder(w).Encode(&handshakeResp{
-		[]string{"NetworkDriver"},
+		[]string{"NetworkDriver", "IpamDriver"},
 	})
 	if err != nil {
 		sendError(w, "encode error", http.StatusInternalServerError)
@@ -134,6 +178,12 @@ func (driver *driver) handshake(w http.ResponseWriter, r *http.Request) {
 
 func (driver *driver) status(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, fmt.Sprintln("weave plugin", driver.version))
+
+	driver.mutex.Lock()
+	defer driver.mutex.Unlock()
+	for id, network := range driver.networks {
+		fmt.Fprintf(w, "network %s: %+v\n", id, driver.networkOperInfo(network))
+	}
 }
 
 var caps = &api.GetCapabilityResponse{
@@ -145,6 +195,31 @@ func (driver *driver) getCapabilities(w http.ResponseWriter, r *http.Request) {
 	Log.Debugf("Get capabilities: responded with %+v", caps)
 }
 
+// subnetFromRequest picks out the IPv4 pool libnetwork/IPAM assigned to
+// a network, and parses it into the net.IPNet we use internally.
+func subnetFromRequest(create *api.CreateNetworkRequest) (*net.IPNet, error) {
+	if len(create.IPv4Data) == 0 || create.IPv4Data[0].Pool == "" {
+		return nil, fmt.Errorf("no IPv4 address pool supplied")
+	}
+	_, subnet, err := net.ParseCIDR(create.IPv4Data[0].Pool)
+	return subnet, err
+}
+
+// driverOption looks up a driver-specific option, which libnetwork
+// passes through either directly or nested under the generic-options
+// label depending on how the network was created (engine API vs CLI).
+func driverOption(options map[string]interface{}, key string) string {
+	if v, ok := options[key].(string); ok {
+		return v
+	}
+	if generic, ok := options[netlabel.GenericData].(map[string]interface{}); ok {
+		if v, ok := generic[key].(string); ok {
+			return v
+		}
+	}
+	return ""
+}
+
 func (driver *driver) createNetwork(w http.ResponseWriter, r *http.Request) {
 	var create api.CreateNetworkRequest
 	err := json.NewDecoder(r.Body).Decode(&create)
@@ -153,33 +228,53 @@ func (driver *driver) createNetwork(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	Log.Debugf("Create network request %+v", &create)
+	netID := create.NetworkID
 
-	if driver.network != "" {
-		errorResponsef(w, "You get just one network, and you already made %s", driver.network)
+	subnet, err := subnetFromRequest(&create)
+	if err != nil {
+		errorResponsef(w, "Unable to create network %s: %s", netID, err)
 		return
 	}
 
-	driver.network = create.NetworkID
-	driver.watcher.WatchNetwork(driver.network)
+	driver.mutex.Lock()
+	defer driver.mutex.Unlock()
+
+	if _, found := driver.networks[netID]; found {
+		errorResponsef(w, "Network %s already exists", netID)
+		return
+	}
+
+	driver.networks[netID] = &networkState{
+		id:         netID,
+		subnet:     subnet,
+		options:    create.Options,
+		addressing: driverOption(create.Options, AddressingOption),
+		endpoints:  make(map[string]*endpointState),
+	}
+
 	emptyResponse(w)
-	Log.Infof("Create network %s", driver.network)
+	Log.Infof("Create network %s (subnet %s)", netID, subnet)
 }
 
 func (driver *driver) deleteNetwork(w http.ResponseWriter, r *http.Request) {
-	var delete api.DeleteNetworkRequest
-	if err := json.NewDecoder(r.Body).Decode(&delete); err != nil {
+	var req api.DeleteNetworkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		sendError(w, "Unable to decode JSON payload: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	Log.Debugf("Delete network request: %+v", &delete)
-	if delete.NetworkID != driver.network {
-		errorResponsef(w, "Network %s not found", delete.NetworkID)
+	Log.Debugf("Delete network request: %+v", &req)
+
+	driver.mutex.Lock()
+	defer driver.mutex.Unlock()
+
+	network, found := driver.networks[req.NetworkID]
+	if !found {
+		errorResponsef(w, "Network %s not found", req.NetworkID)
 		return
 	}
-	driver.network = ""
-	driver.watcher.UnwatchNetwork(delete.NetworkID)
+	Log.Infof("Destroy network %s %+v", req.NetworkID, driver.networkOperInfo(network))
+	delete(driver.networks, req.NetworkID)
 	emptyResponse(w)
-	Log.Infof("Destroy network %s", delete.NetworkID)
 }
 
 func (driver *driver) createEndpoint(w http.ResponseWriter, r *http.Request) {
@@ -192,24 +287,63 @@ func (driver *driver) createEndpoint(w http.ResponseWriter, r *http.Request) {
 	netID := create.NetworkID
 	endID := create.EndpointID
 
-	if netID != driver.network {
+	driver.mutex.Lock()
+	network, found := driver.networks[netID]
+	driver.mutex.Unlock()
+	if !found {
 		errorResponsef(w, "No such network %s", netID)
 		return
 	}
 
-	ip, err := driver.allocateIP(endID)
+	var ep *endpointState
+	if network.addressing == dhcpAddressing {
+		var err error
+		ep, err = driver.createEndpointDHCP(netID, endID)
+		if err != nil {
+			errorResponsef(w, "DHCP addressing failed for endpoint %s: %s", endID, err)
+			return
+		}
+	} else {
+		if create.Interface == nil || create.Interface.Address == "" {
+			errorResponsef(w, "No address supplied by IPAM for endpoint %s", endID)
+			return
+		}
+		addr, err := types.ParseCIDR(create.Interface.Address)
+		if err != nil {
+			errorResponsef(w, "Invalid address %s: %s", create.Interface.Address, err)
+			return
+		}
+		Log.Debugf("Got IP from IPAM %s", addr.String())
+		ep = &endpointState{
+			id:         endID,
+			networkID:  netID,
+			address:    addr,
+			macAddress: makeMac(addr.IP),
+		}
+	}
+
+	portBindings, err := portBindingsFromOptions(create.Options)
+	if err != nil {
+		errorResponsef(w, "Invalid port bindings for endpoint %s: %s", endID, err)
+		return
+	}
+	exposedPorts, err := exposedPortsFromOptions(create.Options)
 	if err != nil {
-		Log.Warningf("Error allocating IP: %s", err)
-		sendError(w, "Unable to allocate IP", http.StatusInternalServerError)
+		errorResponsef(w, "Invalid exposed ports for endpoint %s: %s", endID, err)
 		return
 	}
-	Log.Debugf("Got IP from IPAM %s", ip.String())
+	ep.portBindings = portBindings
+	ep.exposedPorts = exposedPorts
 
-	mac := makeMac(ip.IP)
+	driver.mutex.Lock()
+	network.endpoints[endID] = ep
+	driver.mutex.Unlock()
+
+	driver.watcher.WatchEndpoint(endID, netID)
 
 	respIface := &api.EndpointInterface{
-		Address:    ip.String(),
-		MacAddress: mac,
+		Address:    ep.address.String(),
+		MacAddress: ep.macAddress.String(),
 	}
 	resp := &api.CreateEndpointResponse{
 		Interface: respIface,
@@ -219,18 +353,57 @@ func (driver *driver) createEndpoint(w http.ResponseWriter, r *http.Request) {
 	Log.Infof("Create endpoint %s %+v", endID, resp)
 }
 
+// createEndpointDHCP obtains an address, gateway and DNS servers for an
+// endpoint via DHCP instead of IPAM, and starts the goroutine that keeps
+// the resulting lease renewed.
+func (driver *driver) createEndpointDHCP(netID, endID string) (*endpointState, error) {
+	mac := macForEndpoint(endID)
+	lease, err := driver.dhcpRequest(WeaveBridge, mac)
+	if err != nil {
+		return nil, err
+	}
+	go driver.renewLease(WeaveBridge, endID, lease)
+
+	return &endpointState{
+		id:         endID,
+		networkID:  netID,
+		address:    lease.address,
+		macAddress: mac,
+		gateway:    lease.gateway,
+		dns:        lease.dns,
+		lease:      lease,
+	}, nil
+}
+
 func (driver *driver) deleteEndpoint(w http.ResponseWriter, r *http.Request) {
-	var delete api.DeleteEndpointRequest
-	if err := json.NewDecoder(r.Body).Decode(&delete); err != nil {
+	var req api.DeleteEndpointRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		sendError(w, "Could not decode JSON encode payload", http.StatusBadRequest)
 		return
 	}
-	Log.Debugf("Delete endpoint request: %+v", &delete)
+	Log.Debugf("Delete endpoint request: %+v", &req)
 	emptyResponse(w)
-	if err := driver.releaseIP(delete.EndpointID); err != nil {
-		Log.Warningf("error releasing IP: %s", err)
+
+	driver.mutex.Lock()
+	network, found := driver.networks[req.NetworkID]
+	if !found {
+		driver.mutex.Unlock()
+		Log.Warningf("delete endpoint %s: no such network %s", req.EndpointID, req.NetworkID)
+		return
+	}
+	ep, found := network.endpoints[req.EndpointID]
+	delete(network.endpoints, req.EndpointID)
+	driver.mutex.Unlock()
+
+	driver.watcher.UnwatchEndpoint(req.EndpointID)
+
+	if found {
+		driver.removePortBindings(ep)
+	}
+	if found && ep.lease != nil {
+		driver.releaseLease(WeaveBridge, req.EndpointID, ep.lease)
 	}
-	Log.Infof("Delete endpoint %s", delete.EndpointID)
+	Log.Infof("Delete endpoint %s", req.EndpointID)
 }
 
 func (driver *driver) infoEndpoint(w http.ResponseWriter, r *http.Request) {
@@ -240,7 +413,20 @@ func (driver *driver) infoEndpoint(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	Log.Debugf("Endpoint info request: %+v", &info)
-	objectResponse(w, &api.EndpointInfoResponse{Value: map[string]interface{}{}})
+
+	driver.mutex.Lock()
+	var ep *endpointState
+	if network, found := driver.networks[info.NetworkID]; found {
+		ep = network.endpoints[info.EndpointID]
+	}
+	driver.mutex.Unlock()
+
+	value := map[string]interface{}{}
+	if ep != nil {
+		value = driver.endpointOperInfo(ep)
+	}
+
+	objectResponse(w, &api.EndpointInfoResponse{Value: value})
 	Log.Infof("Endpoint info %s", info.EndpointID)
 }
 
@@ -254,6 +440,21 @@ func (driver *driver) joinEndpoint(w http.ResponseWriter, r *http.Request) {
 
 	endID := j.EndpointID
 
+	driver.mutex.Lock()
+	network, found := driver.networks[j.NetworkID]
+	if !found {
+		driver.mutex.Unlock()
+		errorResponsef(w, "No such network %s", j.NetworkID)
+		return
+	}
+	ep, found := network.endpoints[endID]
+	if !found {
+		driver.mutex.Unlock()
+		errorResponsef(w, "No such endpoint %s", endID)
+		return
+	}
+	driver.mutex.Unlock()
+
 	// create and attach local name to the bridge
 	local := vethPair(endID[:5])
 	if err := netlink.LinkAdd(local); err != nil {
@@ -280,6 +481,13 @@ func (driver *driver) joinEndpoint(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := driver.programPortBindings(ep); err != nil {
+		netlink.LinkDel(local)
+		Log.Error(err)
+		errorResponsef(w, "could not program port bindings: %s", err)
+		return
+	}
+
 	ifname := &api.InterfaceName{
 		SrcName:   local.PeerName,
 		DstPrefix: "ethwe",
@@ -296,6 +504,9 @@ func (driver *driver) joinEndpoint(w http.ResponseWriter, r *http.Request) {
 		}
 		res.StaticRoutes = []api.StaticRoute{routeToDNS}
 	}
+	if ep.gateway != nil {
+		res.Gateway = ep.gateway.String()
+	}
 
 	objectResponse(w, res)
 	Log.Infof("Join endpoint %s:%s to %s", j.NetworkID, j.EndpointID, j.SandboxKey)
@@ -309,6 +520,17 @@ func (driver *driver) leaveEndpoint(w http.ResponseWriter, r *http.Request) {
 	}
 	Log.Debugf("Leave request: %+v", &l)
 
+	driver.mutex.Lock()
+	var ep *endpointState
+	if network, found := driver.networks[l.NetworkID]; found {
+		ep = network.endpoints[l.EndpointID]
+	}
+	driver.mutex.Unlock()
+	driver.removePortBindings(ep)
+	if ep != nil && ep.lease != nil {
+		driver.releaseLease(WeaveBridge, l.EndpointID, ep.lease)
+	}
+
 	local := vethPair(l.EndpointID[:5])
 	if err := netlink.LinkDel(local); err != nil {
 		Log.Warningf("unable to delete veth on leave: %s", err)
@@ -326,10 +548,10 @@ func vethPair(suffix string) *netlink.Veth {
 	}
 }
 
-func makeMac(ip net.IP) string {
+func makeMac(ip net.IP) net.HardwareAddr {
 	hw := make(net.HardwareAddr, 6)
 	hw[0] = 0x7a
 	hw[1] = 0x42
 	copy(hw[2:], ip.To4())
-	return hw.String()
+	return hw
 }
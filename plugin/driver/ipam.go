@@ -0,0 +1,155 @@
+package driver
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+
+	ipamapi "github.com/docker/libnetwork/ipams/remote/api"
+
+	. "github.com/weaveworks/weave/common"
+)
+
+// defaultAddressSpace is the name we advertise for both the local and
+// global address spaces. Weave has no notion of "local" vs "global"
+// pools, so one space serves for both.
+const defaultAddressSpace = "weavedockerplugin"
+
+// ipamPool is a pool of addresses handed out against a single CIDR,
+// identified to libnetwork by its PoolID. Unlike networkState (which
+// only exists once the network driver's CreateNetwork has run), an
+// ipamPool is created by RequestPool, ahead of CreateNetwork.
+type ipamPool struct {
+	id     string
+	subnet *net.IPNet
+	pool   *ipPool
+}
+
+func (driver *driver) ipamGetCapabilities(w http.ResponseWriter, r *http.Request) {
+	objectResponse(w, &ipamapi.GetCapabilitiesResponse{RequiresMACAddress: true})
+	Log.Debugf("IPAM get capabilities")
+}
+
+func (driver *driver) ipamGetDefaultAddressSpaces(w http.ResponseWriter, r *http.Request) {
+	resp := &ipamapi.GetAddressSpacesResponse{
+		LocalDefaultAddressSpace:  defaultAddressSpace,
+		GlobalDefaultAddressSpace: defaultAddressSpace,
+	}
+	objectResponse(w, resp)
+	Log.Debugf("IPAM get default address spaces: responded with %+v", resp)
+}
+
+func (driver *driver) ipamRequestPool(w http.ResponseWriter, r *http.Request) {
+	var req ipamapi.RequestPoolRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, "Unable to decode JSON payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	Log.Debugf("Request pool request: %+v", &req)
+
+	if req.Pool == "" {
+		errorResponsef(w, "weave IPAM requires an explicit --subnet")
+		return
+	}
+	_, subnet, err := net.ParseCIDR(req.Pool)
+	if err != nil {
+		errorResponsef(w, "Invalid subnet %s: %s", req.Pool, err)
+		return
+	}
+
+	driver.mutex.Lock()
+	defer driver.mutex.Unlock()
+
+	poolID := subnet.String()
+	if _, found := driver.ipamPools[poolID]; !found {
+		driver.ipamPools[poolID] = &ipamPool{
+			id:     poolID,
+			subnet: subnet,
+			pool:   newIPPool(subnet),
+		}
+	}
+
+	objectResponse(w, &ipamapi.RequestPoolResponse{
+		PoolID: poolID,
+		Pool:   subnet.String(),
+	})
+	Log.Infof("Request pool %s -> %s", req.Pool, poolID)
+}
+
+func (driver *driver) ipamReleasePool(w http.ResponseWriter, r *http.Request) {
+	var req ipamapi.ReleasePoolRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, "Unable to decode JSON payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	Log.Debugf("Release pool request: %+v", &req)
+
+	driver.mutex.Lock()
+	delete(driver.ipamPools, req.PoolID)
+	driver.mutex.Unlock()
+
+	emptyResponse(w)
+	Log.Infof("Release pool %s", req.PoolID)
+}
+
+func (driver *driver) ipamRequestAddress(w http.ResponseWriter, r *http.Request) {
+	var req ipamapi.RequestAddressRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, "Unable to decode JSON payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	Log.Debugf("Request address request: %+v", &req)
+
+	driver.mutex.Lock()
+	pool, found := driver.ipamPools[req.PoolID]
+	if !found {
+		driver.mutex.Unlock()
+		errorResponsef(w, "No such pool %s", req.PoolID)
+		return
+	}
+
+	var addr *net.IPNet
+	var err error
+	if req.Address != "" {
+		ip := net.ParseIP(req.Address)
+		if ip == nil {
+			driver.mutex.Unlock()
+			errorResponsef(w, "Invalid address %s", req.Address)
+			return
+		}
+		ones, bits := pool.subnet.Mask.Size()
+		addr = &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, bits)}
+	} else {
+		addr, err = pool.pool.allocate()
+	}
+	driver.mutex.Unlock()
+
+	if err != nil {
+		Log.Warningf("Error allocating IP: %s", err)
+		sendError(w, "Unable to allocate IP", http.StatusInternalServerError)
+		return
+	}
+
+	objectResponse(w, &ipamapi.RequestAddressResponse{Address: addr.String()})
+	Log.Infof("Request address on pool %s -> %s", req.PoolID, addr)
+}
+
+func (driver *driver) ipamReleaseAddress(w http.ResponseWriter, r *http.Request) {
+	var req ipamapi.ReleaseAddressRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, "Unable to decode JSON payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	Log.Debugf("Release address request: %+v", &req)
+
+	driver.mutex.Lock()
+	if pool, found := driver.ipamPools[req.PoolID]; found {
+		if ip := net.ParseIP(req.Address); ip != nil {
+			pool.pool.release(ip)
+		}
+	}
+	driver.mutex.Unlock()
+
+	emptyResponse(w)
+	Log.Infof("Release address %s on pool %s", req.Address, req.PoolID)
+}
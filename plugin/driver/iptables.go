@@ -0,0 +1,131 @@
+package driver
+
+import (
+	"fmt"
+	"os/exec"
+
+	"github.com/docker/libnetwork/types"
+)
+
+// Port bindings are programmed into our own chains, hooked into the
+// built-in nat table, rather than Docker's own DOCKER/MASQUERADE chains -
+// this plugin isn't involved in Docker's own bridge networks and
+// shouldn't fight with whatever rules docker0 already has there.
+const (
+	dnatChain = "WEAVE-PLUGIN-DNAT"
+	snatChain = "WEAVE-PLUGIN-SNAT"
+)
+
+// ensurePortChains makes sure our DNAT/MASQUERADE chains exist and are
+// hooked into PREROUTING/OUTPUT/POSTROUTING. Safe to call repeatedly.
+func ensurePortChains() error {
+	for _, chain := range []string{dnatChain, snatChain} {
+		// -N fails harmlessly if the chain already exists.
+		exec.Command("iptables", "-t", "nat", "-N", chain).Run()
+	}
+	if err := iptablesAppendUnique("nat", "PREROUTING", "-j", dnatChain); err != nil {
+		return err
+	}
+	if err := iptablesAppendUnique("nat", "OUTPUT", "-j", dnatChain); err != nil {
+		return err
+	}
+	return iptablesAppendUnique("nat", "POSTROUTING", "-j", snatChain)
+}
+
+// iptablesAppendUnique appends a rule to table/chain unless it is
+// already there, so repeated calls (e.g. across plugin restarts) are
+// idempotent.
+func iptablesAppendUnique(table, chain string, ruleSpec ...string) error {
+	checkArgs := append([]string{"-t", table, "-C", chain}, ruleSpec...)
+	if exec.Command("iptables", checkArgs...).Run() == nil {
+		return nil
+	}
+	appendArgs := append([]string{"-t", table, "-A", chain}, ruleSpec...)
+	if out, err := exec.Command("iptables", appendArgs...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s (%s)", err, out)
+	}
+	return nil
+}
+
+// iptablesDelete removes a rule. It doesn't report whether the rule was
+// there to begin with, which is what makes repeated calls from cleanup
+// paths safe.
+func iptablesDelete(table, chain string, ruleSpec ...string) {
+	args := append([]string{"-t", table, "-D", chain}, ruleSpec...)
+	exec.Command("iptables", args...).Run()
+}
+
+func dnatRuleSpec(binding types.PortBinding, containerIP string) []string {
+	// With no specific host IP, match any of the host's own addresses;
+	// "-d 0.0.0.0" would mean 0.0.0.0/32 to iptables and match nothing.
+	dest := []string{"-m", "addrtype", "--dst-type", "LOCAL"}
+	if len(binding.HostIP) != 0 && !binding.HostIP.IsUnspecified() {
+		dest = []string{"-d", binding.HostIP.String()}
+	}
+	spec := append([]string{"-p", binding.Proto.String()}, dest...)
+	return append(spec,
+		"--dport", fmt.Sprintf("%d", binding.HostPort),
+		"-j", "DNAT",
+		"--to-destination", fmt.Sprintf("%s:%d", containerIP, binding.Port),
+	)
+}
+
+// hairpinRuleSpec lets other processes and containers on the same host
+// reach a published port via the host's own address, the way they
+// would reach it from outside; without it, the DNAT above is invisible
+// to same-host traffic because the reply never passes back through
+// PREROUTING to be un-NATed. It is restricted to traffic originating on
+// this host (-m addrtype --src-type LOCAL), matching Docker's own
+// hairpin rule, so it doesn't also masquerade ordinary container-to-
+// container traffic arriving over weave from other peers, which never
+// went through the DNAT chain and needs no such rewriting.
+func hairpinRuleSpec(binding types.PortBinding, containerIP string) []string {
+	return []string{
+		"-p", binding.Proto.String(),
+		"-d", containerIP,
+		"--dport", fmt.Sprintf("%d", binding.Port),
+		"-m", "addrtype", "--src-type", "LOCAL",
+		"-j", "MASQUERADE",
+	}
+}
+
+// programPortBindings adds the DNAT and hairpin-MASQUERADE rules for
+// every host-facing binding on ep.
+func (driver *driver) programPortBindings(ep *endpointState) error {
+	if len(ep.portBindings) == 0 {
+		return nil
+	}
+	if err := ensurePortChains(); err != nil {
+		return fmt.Errorf("could not set up port publishing chains: %s", err)
+	}
+	containerIP := ep.address.IP.String()
+	for _, binding := range ep.portBindings {
+		if binding.HostPort == 0 {
+			continue
+		}
+		if err := iptablesAppendUnique("nat", dnatChain, dnatRuleSpec(binding, containerIP)...); err != nil {
+			return fmt.Errorf("DNAT rule for %d->%s:%d: %s", binding.HostPort, containerIP, binding.Port, err)
+		}
+		if err := iptablesAppendUnique("nat", snatChain, hairpinRuleSpec(binding, containerIP)...); err != nil {
+			return fmt.Errorf("hairpin rule for %s:%d: %s", containerIP, binding.Port, err)
+		}
+	}
+	return nil
+}
+
+// removePortBindings reverses programPortBindings. It is safe to call
+// more than once for the same endpoint, and safe to call for an
+// endpoint whose rules were never programmed.
+func (driver *driver) removePortBindings(ep *endpointState) {
+	if ep == nil || len(ep.portBindings) == 0 {
+		return
+	}
+	containerIP := ep.address.IP.String()
+	for _, binding := range ep.portBindings {
+		if binding.HostPort == 0 {
+			continue
+		}
+		iptablesDelete("nat", dnatChain, dnatRuleSpec(binding, containerIP)...)
+		iptablesDelete("nat", snatChain, hairpinRuleSpec(binding, containerIP)...)
+	}
+}
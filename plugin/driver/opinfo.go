@@ -0,0 +1,108 @@
+package driver
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/vishvananda/netlink"
+
+	. "github.com/weaveworks/weave/common"
+)
+
+// peerInfo is one entry from the bridge's forwarding database: a MAC
+// address and the IP we have seen it using.
+type peerInfo struct {
+	MAC string
+	IP  string
+}
+
+// bridgeFDB returns the MAC/IP pairs the kernel has learned on
+// WeaveBridge - the peers an endpoint's traffic can reach without
+// the weave router doing anything further.
+func bridgeFDB() ([]peerInfo, error) {
+	link, err := netlink.LinkByName(WeaveBridge)
+	if err != nil {
+		return nil, err
+	}
+	neighs, err := netlink.NeighList(link.Attrs().Index, syscall.AF_BRIDGE)
+	if err != nil {
+		return nil, err
+	}
+	var peers []peerInfo
+	for _, n := range neighs {
+		if n.IP == nil || n.HardwareAddr == nil {
+			continue
+		}
+		peers = append(peers, peerInfo{MAC: n.HardwareAddr.String(), IP: n.IP.String()})
+	}
+	return peers, nil
+}
+
+// poolForAddress reports which IPAM pool (see ipam.go) handed out addr,
+// if any - an endpoint whose network uses DHCP addressing has none.
+func (driver *driver) poolForAddress(addr net.IP) string {
+	driver.mutex.Lock()
+	defer driver.mutex.Unlock()
+	for id, pool := range driver.ipamPools {
+		if pool.subnet.Contains(addr) {
+			return id
+		}
+	}
+	return ""
+}
+
+// endpointOperInfo builds the verbose operational info for one
+// endpoint: the veth it rides on, the router peer its traffic egresses
+// through, the IPAM pool its address came from, the peers visible on
+// its network's bridge, its port bindings (if set up), and its DNS
+// servers (if it got them from DHCP - IPAM-addressed endpoints have
+// none of their own).
+func (driver *driver) endpointOperInfo(ep *endpointState) map[string]interface{} {
+	info := map[string]interface{}{
+		"weave.veth.name": vethPair(ep.id[:5]).PeerName,
+	}
+	if peer := localPeerName(); peer != "" {
+		info["weave.router.peer"] = peer
+	}
+	if poolID := driver.poolForAddress(ep.address.IP); poolID != "" {
+		info["weave.ipam.pool"] = poolID
+	}
+	if peers, err := bridgeFDB(); err == nil {
+		info["weave.peers"] = peers
+	} else {
+		Log.Debugf("endpoint info: could not read bridge FDB: %s", err)
+	}
+	if len(ep.portBindings) > 0 {
+		info[netlabel.PortMap] = ep.portBindings
+	}
+	if len(ep.dns) > 0 {
+		dns := make([]string, len(ep.dns))
+		for i, ip := range ep.dns {
+			dns[i] = ip.String()
+		}
+		info["weave.dns"] = dns
+	}
+	return info
+}
+
+// networkOperInfo is the NetworkOperInfo-ish counterpart: a summary of
+// one network's state, used by the status page and logged when the
+// network is torn down, so an operator doesn't have to shell into the
+// weave container to see what the plugin thought was going on.
+func (driver *driver) networkOperInfo(network *networkState) map[string]interface{} {
+	info := map[string]interface{}{
+		"weave.addressing": "ipam",
+		"weave.endpoints":  len(network.endpoints),
+	}
+	if network.subnet != nil {
+		info["weave.subnet"] = network.subnet.String()
+	}
+	if network.addressing != "" {
+		info["weave.addressing"] = network.addressing
+	}
+	if peers, err := bridgeFDB(); err == nil {
+		info["weave.peers"] = peers
+	}
+	return info
+}
@@ -0,0 +1,72 @@
+package driver
+
+import (
+	"fmt"
+	"net"
+)
+
+// ipPool hands out addresses from a network's subnet, one per endpoint.
+// It belongs to a single ipamPool and is protected by the driver's
+// mutex, not its own.
+type ipPool struct {
+	subnet *net.IPNet
+	start  net.IP
+	next   net.IP
+	used   map[string]bool
+}
+
+func newIPPool(subnet *net.IPNet) *ipPool {
+	start := make(net.IP, len(subnet.IP))
+	copy(start, subnet.IP)
+	incIP(start) // skip the network address itself
+	next := make(net.IP, len(start))
+	copy(next, start)
+	return &ipPool{
+		subnet: subnet,
+		start:  start,
+		next:   next,
+		used:   make(map[string]bool),
+	}
+}
+
+// allocate hands out the next free address, wrapping p.next back to the
+// start of the subnet once it runs off the end so that addresses
+// released by a long-since-deleted endpoint get reused rather than
+// leaking for the remaining lifetime of the network.
+func (p *ipPool) allocate() (*net.IPNet, error) {
+	ones, bits := p.subnet.Mask.Size()
+	if !p.subnet.Contains(p.next) {
+		copy(p.next, p.start)
+	}
+	first := p.next.String()
+	for {
+		ip := make(net.IP, len(p.next))
+		copy(ip, p.next)
+
+		incIP(p.next)
+		if !p.subnet.Contains(p.next) {
+			copy(p.next, p.start)
+		}
+
+		if !p.used[ip.String()] {
+			p.used[ip.String()] = true
+			return &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, bits)}, nil
+		}
+		if p.next.String() == first {
+			return nil, fmt.Errorf("address pool exhausted for %s", p.subnet)
+		}
+	}
+}
+
+func (p *ipPool) release(ip net.IP) {
+	delete(p.used, ip.String())
+}
+
+func incIP(ip net.IP) {
+	for i := len(ip) - 1; i >= 0; i-- {
+		ip[i]++
+		if ip[i] != 0 {
+			break
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package driver
+
+import (
+	"encoding/json"
+
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/libnetwork/types"
+)
+
+// portBindingsFromOptions and exposedPortsFromOptions pick the port
+// publishing information libnetwork attaches to CreateEndpointRequest
+// out of its generic Options bag. They arrive there JSON-decoded into
+// interface{}, so the simplest way to get back the typed libnetwork
+// structs is to round-trip them through encoding/json.
+func portBindingsFromOptions(options map[string]interface{}) ([]types.PortBinding, error) {
+	raw, ok := options[netlabel.PortMap]
+	if !ok {
+		return nil, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var bindings []types.PortBinding
+	if err := json.Unmarshal(data, &bindings); err != nil {
+		return nil, err
+	}
+	return bindings, nil
+}
+
+func exposedPortsFromOptions(options map[string]interface{}) ([]types.TransportPort, error) {
+	raw, ok := options[netlabel.ExposedPorts]
+	if !ok {
+		return nil, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var ports []types.TransportPort
+	if err := json.Unmarshal(data, &ports); err != nil {
+		return nil, err
+	}
+	return ports, nil
+}
@@ -2,7 +2,8 @@ package driver
 
 import (
 	"fmt"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 	. "github.com/weaveworks/weave/common"
@@ -11,91 +12,289 @@ import (
 const (
 	WeaveDNSContainer = "weavedns"
 	WeaveDomain       = "weave.local"
+
+	initialReconnectBackoff = 1 * time.Second
+	maxReconnectBackoff     = 1 * time.Minute
 )
 
 type watcher struct {
 	dockerer
-	networks map[string]bool
-	events   chan *docker.APIEvents
+
+	mutex      sync.Mutex
+	endpoints  map[string]string            // endpoint ID -> network ID
+	registered map[string]bool              // endpoint IDs we have told weaveDNS about
+	containers map[string]map[string]string // container ID -> (endpoint ID -> ip), for events where the container is already gone
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// attachment is one of a container's endpoints on a network this
+// plugin manages - a container can have more than one, e.g. if it is
+// attached to two weave-driver networks at once.
+type attachment struct {
+	endpointID string
+	ip         string
 }
 
 type Watcher interface {
-	WatchNetwork(uuid string)
-	UnwatchNetwork(uuid string)
+	WatchEndpoint(endpointID, networkID string)
+	UnwatchEndpoint(endpointID string)
+	Close()
 }
 
 func NewWatcher(client *docker.Client) (Watcher, error) {
 	w := &watcher{
-		dockerer: dockerer{
-			client: client,
-		},
-		networks: make(map[string]bool),
-		events:   make(chan *docker.APIEvents),
+		dockerer:   dockerer{client: client},
+		endpoints:  make(map[string]string),
+		registered: make(map[string]bool),
+		containers: make(map[string]map[string]string),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
 	}
-	err := client.AddEventListener(w.events)
-	if err != nil {
-		return nil, err
+	go w.run()
+	return w, nil
+}
+
+// Close tears down the event-watching goroutine, waiting for it to
+// exit. It is safe to call once; driver.Listen has nothing else that
+// needs it, but it lets tests construct and tear down a driver without
+// leaking a goroutine per test.
+func (w *watcher) Close() {
+	close(w.stop)
+	<-w.done
+}
+
+func (w *watcher) WatchEndpoint(endpointID, networkID string) {
+	Debug.Printf("Watch endpoint %s on network %s", endpointID, networkID)
+	w.mutex.Lock()
+	w.endpoints[endpointID] = networkID
+	w.mutex.Unlock()
+}
+
+func (w *watcher) UnwatchEndpoint(endpointID string) {
+	Debug.Printf("Unwatch endpoint %s", endpointID)
+	w.mutex.Lock()
+	delete(w.endpoints, endpointID)
+	delete(w.registered, endpointID)
+	w.mutex.Unlock()
+}
+
+// run owns the connection to the docker event stream for the lifetime
+// of the watcher. Unlike a single AddEventListener call, it never gives
+// up: a lost or refused connection is retried with exponential backoff,
+// and every successful (re)connection is followed by a reconciliation
+// pass so that events missed while disconnected don't leave weaveDNS
+// with stale or missing registrations.
+func (w *watcher) run() {
+	defer close(w.done)
+
+	backoff := initialReconnectBackoff
+	for {
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+
+		events := make(chan *docker.APIEvents)
+		if err := w.client.AddEventListener(events); err != nil {
+			Warning.Printf("could not register docker event listener: %s", err)
+			if !w.sleep(backoff) {
+				return
+			}
+			backoff = nextBackoff(backoff)
+			continue
+		}
+		backoff = initialReconnectBackoff
+
+		Debug.Printf("connected to docker event stream; reconciling DNS registrations")
+		w.reconcile()
+
+		if !w.drain(events) {
+			w.client.RemoveEventListener(events)
+			return
+		}
+		Warning.Printf("lost docker event stream; reconnecting")
 	}
+}
 
-	go func() {
-		for event := range w.events {
-			switch event.Status {
-			case "start":
-				w.ContainerStart(event.ID)
-			case "die":
-				w.ContainerDied(event.ID)
+// drain processes events until the stream is closed (returning true, so
+// the caller reconnects) or Close is called (returning false).
+func (w *watcher) drain(events chan *docker.APIEvents) bool {
+	for {
+		select {
+		case <-w.stop:
+			return false
+		case event, ok := <-events:
+			if !ok {
+				return true
 			}
+			w.handleEvent(event)
 		}
-	}()
+	}
+}
 
-	return w, nil
+func (w *watcher) sleep(d time.Duration) bool {
+	select {
+	case <-w.stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
 }
 
-func (w *watcher) WatchNetwork(uuid string) {
-	Debug.Printf("Watch network %s", uuid)
-	w.networks[uuid] = true
+func nextBackoff(d time.Duration) time.Duration {
+	d *= 2
+	if d > maxReconnectBackoff {
+		return maxReconnectBackoff
+	}
+	return d
 }
 
-func (w *watcher) UnwatchNetwork(uuid string) {
-	Debug.Printf("Unwatch network %s", uuid)
-	delete(w.networks, uuid)
+func (w *watcher) handleEvent(event *docker.APIEvents) {
+	switch event.Status {
+	case "start":
+		w.ContainerStart(event.ID)
+	case "die", "destroy", "oom":
+		w.ContainerDied(event.ID)
+	}
 }
 
-func (w *watcher) ContainerStart(id string) {
-	Debug.Printf("Container started %s", id)
-	info, err := w.InspectContainer(id)
+// reconcile brings weaveDNS registrations in line with the containers
+// actually running right now. It is the only place that deals with
+// containers wholesale rather than one event at a time, which is what
+// lets it catch up on events lost to a disconnected event stream.
+func (w *watcher) reconcile() {
+	containers, err := w.ListContainers(docker.ListContainersOptions{})
 	if err != nil {
-		Warning.Printf("error inspecting container: %s", err)
+		Warning.Printf("could not list containers to reconcile DNS registrations: %s", err)
+		return
+	}
+
+	current := make(map[string]bool)
+	for _, c := range containers {
+		info, err := w.InspectContainer(c.ID)
+		if err != nil {
+			Warning.Printf("error inspecting container: %s", err)
+			continue
+		}
+		for _, a := range w.weaveNetwork(info) {
+			current[a.endpointID] = true
+			w.register(a.endpointID, c.ID, info.Config.Hostname, a.ip)
+		}
+	}
+
+	for _, endpointID := range w.registeredEndpoints() {
+		if !current[endpointID] {
+			w.deregister(endpointID, "")
+		}
+	}
+}
+
+func (w *watcher) registeredEndpoints() []string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	endpointIDs := make([]string, 0, len(w.registered))
+	for endpointID := range w.registered {
+		endpointIDs = append(endpointIDs, endpointID)
+	}
+	return endpointIDs
+}
+
+// weaveNetwork picks out all of a container's attached networks this
+// plugin joined it to, identified by the endpoint ID libnetwork gave us
+// at CreateEndpoint time - usually one, but a container can be
+// attached to more than one weave-driver network at once. This
+// replaces the old Config.Domainname subdomain sniffing, which could
+// only ever find one such network and couldn't distinguish it from any
+// other network the container was also on.
+func (w *watcher) weaveNetwork(info *docker.Container) []attachment {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	var attachments []attachment
+	for _, settings := range info.NetworkSettings.Networks {
+		if _, found := w.endpoints[settings.EndpointID]; found {
+			attachments = append(attachments, attachment{settings.EndpointID, settings.IPAddress})
+		}
+	}
+	return attachments
+}
+
+func (w *watcher) register(endpointID, containerID, hostname, ip string) {
+	w.mutex.Lock()
+	already := w.registered[endpointID]
+	if w.containers[containerID] == nil {
+		w.containers[containerID] = make(map[string]string)
+	}
+	w.containers[containerID][endpointID] = ip
+	w.mutex.Unlock()
+	if already {
+		return
+	}
+	fqdn := fmt.Sprintf("%s.%s", hostname, WeaveDomain)
+	if err := w.registerWithDNS(endpointID, fqdn, ip); err != nil {
+		Warning.Printf("unable to register with weaveDNS: %s", err)
+		return
+	}
+	w.mutex.Lock()
+	w.registered[endpointID] = true
+	w.mutex.Unlock()
+}
+
+func (w *watcher) deregister(endpointID, ip string) {
+	if err := w.deregisterWithDNS(endpointID, ip); err != nil {
+		Warning.Printf("unable to deregister with weaveDNS: %s", err)
 		return
 	}
-	// FIXME: check that it's on our network; but, the docker client lib doesn't know about .NetworkID
-	if isSubdomain(info.Config.Domainname, WeaveDomain) {
-		// one of ours
-		ip := info.NetworkSettings.IPAddress
-		fqdn := fmt.Sprintf("%s.%s", info.Config.Hostname, info.Config.Domainname)
-		if err := w.registerWithDNS(id, fqdn, ip); err != nil {
-			Warning.Printf("unable to register with weaveDNS: %s", err)
+	w.mutex.Lock()
+	delete(w.registered, endpointID)
+	for containerID, eps := range w.containers {
+		delete(eps, endpointID)
+		if len(eps) == 0 {
+			delete(w.containers, containerID)
 		}
 	}
+	w.mutex.Unlock()
 }
 
-func (w *watcher) ContainerDied(id string) {
-	Debug.Printf("Container died %s", id)
+func (w *watcher) ContainerStart(id string) {
+	Debug.Printf("Container started %s", id)
 	info, err := w.InspectContainer(id)
 	if err != nil {
 		Warning.Printf("error inspecting container: %s", err)
 		return
 	}
-	if isSubdomain(info.Config.Domainname, WeaveDomain) {
-		ip := info.NetworkSettings.IPAddress
-		if err := w.deregisterWithDNS(id, ip); err != nil {
-			Warning.Printf("unable to deregister with weaveDNS: %s", err)
-		}
+	for _, a := range w.weaveNetwork(info) {
+		w.register(a.endpointID, id, info.Config.Hostname, a.ip)
 	}
 }
 
-// Cheap and cheerful way to check x is, or is a subdomain, of
-// y. Neither are expected to start with a '.'.
-func isSubdomain(x string, y string) bool {
-	return x == y || strings.HasSuffix(x, "."+y)
+// ContainerDied handles "die", "destroy" and "oom" events - "kill" is
+// deliberately not one of them, since Docker emits it for every signal
+// sent via "docker kill -s", including ones a container can survive
+// (SIGHUP for a graceful reload, say); "die" is what actually tells us
+// the container has exited. By the time a "destroy" event arrives the
+// container may already be gone, so this falls back to the endpoint ID
+// recorded at start-of-day rather than insisting on a fresh inspect.
+func (w *watcher) ContainerDied(id string) {
+	Debug.Printf("Container died %s", id)
+	for _, a := range w.weaveNetworkFor(id) {
+		w.deregister(a.endpointID, a.ip)
+	}
+}
+
+func (w *watcher) weaveNetworkFor(containerID string) []attachment {
+	if info, err := w.InspectContainer(containerID); err == nil {
+		if attachments := w.weaveNetwork(info); len(attachments) > 0 {
+			return attachments
+		}
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	var attachments []attachment
+	for endpointID, ip := range w.containers[containerID] {
+		attachments = append(attachments, attachment{endpointID, ip})
+	}
+	return attachments
 }
@@ -0,0 +1,107 @@
+package driver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+func TestNextBackoff(t *testing.T) {
+	d := initialReconnectBackoff
+	for i := 0; i < 10; i++ {
+		next := nextBackoff(d)
+		if next < d {
+			t.Fatalf("nextBackoff(%s) = %s, want >= %s", d, next, d)
+		}
+		if next > maxReconnectBackoff {
+			t.Fatalf("nextBackoff(%s) = %s, want <= %s", d, next, maxReconnectBackoff)
+		}
+		d = next
+	}
+	if d != maxReconnectBackoff {
+		t.Fatalf("backoff did not converge to the cap: got %s, want %s", d, maxReconnectBackoff)
+	}
+}
+
+func newTestWatcher() *watcher {
+	return &watcher{
+		endpoints:  make(map[string]string),
+		registered: make(map[string]bool),
+		containers: make(map[string]map[string]string),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+func TestDrainStopsWhenClosed(t *testing.T) {
+	w := newTestWatcher()
+	events := make(chan *docker.APIEvents)
+	close(w.stop)
+
+	if reconnect := w.drain(events); reconnect {
+		t.Fatal("drain should report no-reconnect once stop is closed")
+	}
+}
+
+func TestDrainReconnectsWhenStreamCloses(t *testing.T) {
+	w := newTestWatcher()
+	events := make(chan *docker.APIEvents)
+	close(events)
+
+	if reconnect := w.drain(events); !reconnect {
+		t.Fatal("drain should ask to reconnect when the event channel is closed")
+	}
+}
+
+func TestDrainIgnoresUnhandledEventStatus(t *testing.T) {
+	w := newTestWatcher()
+	events := make(chan *docker.APIEvents, 1)
+	events <- &docker.APIEvents{Status: "pause", ID: "deadbeef"}
+	close(events)
+
+	// handleEvent only calls into the docker client for "start",
+	// "die", "destroy" and "oom"; anything else must be a no-op so
+	// drain can process events without a real client configured.
+	if reconnect := w.drain(events); !reconnect {
+		t.Fatal("drain should ask to reconnect when the event channel is closed")
+	}
+}
+
+func TestWatchAndUnwatchEndpoint(t *testing.T) {
+	w := newTestWatcher()
+	w.WatchEndpoint("ep1", "net1")
+	if netID := w.endpoints["ep1"]; netID != "net1" {
+		t.Fatalf("endpoints[ep1] = %q, want net1", netID)
+	}
+
+	w.registered["ep1"] = true
+	w.UnwatchEndpoint("ep1")
+
+	if _, found := w.endpoints["ep1"]; found {
+		t.Fatal("UnwatchEndpoint should remove the endpoint from endpoints")
+	}
+	if _, found := w.registered["ep1"]; found {
+		t.Fatal("UnwatchEndpoint should also clear any DNS registration bookkeeping")
+	}
+}
+
+func TestClose(t *testing.T) {
+	w := newTestWatcher()
+	go func() {
+		<-w.stop
+		close(w.done)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		w.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return once done was closed")
+	}
+}
@@ -0,0 +1,36 @@
+package driver
+
+import (
+	"bufio"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// The weave router's own status page, which it serves as plain text
+// alongside its HTTP API.
+const weaveStatusURL = "http://127.0.0.1:6784/status"
+
+var ourNameRE = regexp.MustCompile(`Our name is ([0-9a-f:]+)`)
+
+// localPeerName asks the weave router running on this host for its own
+// peer name: the identity its traffic towards other peers carries, and
+// so the one an endpoint's traffic egresses through. Best-effort - it
+// returns "" if the router can't be reached or its status page has
+// changed shape.
+func localPeerName() string {
+	client := http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(weaveStatusURL)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if m := ourNameRE.FindStringSubmatch(scanner.Text()); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}